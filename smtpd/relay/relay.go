@@ -0,0 +1,76 @@
+// Package relay provides an smtpd.Envelope implementation that
+// forwards received mail to a pluggable upstream instead of storing
+// it, turning an smtpd.Server into a submission relay or proxy.
+package relay
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/donnchadh/donnchadh-go-smtpd/smtpd"
+)
+
+// Forwarder is implemented by relay backends. Forward is called once
+// per message, after the client has sent the final "\r\n.\r\n", with
+// the complete MIME message and the envelope collected from MAIL
+// FROM/RCPT TO.
+type Forwarder interface {
+	Forward(from string, to []string, msg io.Reader) error
+}
+
+// FuncForwarder adapts a plain function to the Forwarder interface,
+// for forwarding to arbitrary sinks (cloud email APIs, Kafka, files).
+type FuncForwarder func(from string, to []string, msg io.Reader) error
+
+func (f FuncForwarder) Forward(from string, to []string, msg io.Reader) error {
+	return f(from, to, msg)
+}
+
+// RelayEnvelope is an smtpd.Envelope that buffers the DATA stream in
+// memory and, once the client sends the final ".\r\n", hands the
+// complete message to a Forwarder.
+type RelayEnvelope struct {
+	From      smtpd.MailAddress
+	Forwarder Forwarder
+
+	rcpts []string
+	buf   bytes.Buffer
+}
+
+// NewRelayEnvelope returns a RelayEnvelope that will forward mail
+// from "from" to fwd once DATA completes. It's typically constructed
+// from Server.OnNewMail:
+//
+//	srv.OnNewMail = func(c smtpd.Connection, from smtpd.MailAddress, opts smtpd.MailOptions) (smtpd.Envelope, error) {
+//		return relay.NewRelayEnvelope(from, fwd), nil
+//	}
+func NewRelayEnvelope(from smtpd.MailAddress, fwd Forwarder) *RelayEnvelope {
+	return &RelayEnvelope{From: from, Forwarder: fwd}
+}
+
+func (e *RelayEnvelope) AddRecipient(rcpt smtpd.MailAddress, opts smtpd.RcptOptions) error {
+	e.rcpts = append(e.rcpts, rcpt.Email())
+	return nil
+}
+
+func (e *RelayEnvelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	return nil
+}
+
+func (e *RelayEnvelope) Write(line []byte) error {
+	e.buf.Write(line)
+	return nil
+}
+
+// Close implements smtpd.EnvelopeCloser. If the message was received
+// intact, it hands the buffered MIME message to the Forwarder; if it
+// was aborted, the buffer is simply discarded.
+func (e *RelayEnvelope) Close(ok bool) error {
+	if !ok || e.Forwarder == nil {
+		return nil
+	}
+	return e.Forwarder.Forward(e.From.Email(), e.rcpts, bytes.NewBuffer(e.buf.Bytes()))
+}
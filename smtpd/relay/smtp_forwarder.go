@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// defaultForwardTimeout bounds the whole upstream exchange -- dial
+// through QUIT -- when SMTPForwarder.Timeout is unset.
+const defaultForwardTimeout = 30 * 1e9 // 30s, in ns
+
+// SMTPForwarder is a reference Forwarder that relays each message to
+// a single upstream SMTP server (such as a cloud provider's
+// submission endpoint), using STARTTLS and AUTH when the upstream
+// offers them.
+type SMTPForwarder struct {
+	Addr string // upstream "host:port"
+
+	// Hostname is the name given in EHLO to the upstream; "" uses
+	// Addr's host part.
+	Hostname string
+
+	// TLSConfig, if non-nil, is used to STARTTLS to the upstream when
+	// it's offered.
+	TLSConfig *tls.Config
+
+	// Auth, if non-nil, authenticates to the upstream when AUTH is
+	// offered.
+	Auth smtp.Auth
+
+	// Timeout bounds the dial plus the entire upstream conversation
+	// (EHLO through QUIT, including copying msg), in nanoseconds --
+	// the same convention as smtpd.Server.ReadTimeout -- so a
+	// black-holed or slow-drip upstream can't pin the calling
+	// session's goroutine forever. Zero means defaultForwardTimeout
+	// (30s).
+	Timeout int64
+}
+
+func (f *SMTPForwarder) timeout() int64 {
+	if f.Timeout != 0 {
+		return f.Timeout
+	}
+	return defaultForwardTimeout
+}
+
+func (f *SMTPForwarder) Forward(from string, to []string, msg io.Reader) error {
+	timeout := time.Duration(f.timeout())
+	deadline := time.Now().Add(timeout)
+
+	conn, err := net.DialTimeout("tcp", f.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	// A single absolute deadline, set once, bounds the whole exchange
+	// (EHLO through QUIT); per-call idle timeouts would let a
+	// slow-drip upstream that trickles a byte just inside each
+	// deadline stall the conversation indefinitely.
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, f.hostname())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(f.hostname()); err != nil {
+		return err
+	}
+	if f.TLSConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(f.TLSConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(f.Auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (f *SMTPForwarder) hostname() string {
+	if f.Hostname != "" {
+		return f.Hostname
+	}
+	if host, _, err := net.SplitHostPort(f.Addr); err == nil {
+		return host
+	}
+	return f.Addr
+}
@@ -2,84 +2,211 @@
 // its behavior.
 package smtpd
 
-// TODO:
-//  -- send 421 to connected clients on graceful server shutdown (s3.8)
-//
-
 import (
 	"bufio"
 	"bytes"
-	"exec"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"os"
-	"exp/regexp"
+	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 var (
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
+	rcptToRE = regexp.MustCompile(`[Tt][Oo]:<([^>]*)>[ \t]*(.*)`)
 	//mailFromRE = regexp.MustCompile(`(?i)^from:\s*<(.*?)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<([^>]*)>[ \t]*(.*)`)
 )
 
 // Server is an SMTP server.
 type Server struct {
 	Addr         string // TCP address to listen on, ":25" if empty
 	Hostname     string // optional Hostname to announce; "" to use system hostname
-	ReadTimeout  int64  // optional net.Conn.SetReadTimeout value for new connections
-	WriteTimeout int64  // optional net.Conn.SetWriteTimeout value for new connections
+	ReadTimeout  int64  // optional per-read deadline (ns) for new connections
+	WriteTimeout int64  // optional per-write deadline (ns) for new connections
+
+	// MaxMessageBytes is the maximum size, in bytes, of a message's
+	// DATA, advertised via the SIZE extension and enforced while
+	// reading DATA. Zero means defaultMaxMessageBytes (10MB).
+	MaxMessageBytes int64
+
+	// TLSConfig, if non-nil, enables STARTTLS support and is used to
+	// complete the TLS handshake.  It is also used as-is by
+	// ListenAndServeTLS for implicit TLS.
+	TLSConfig *tls.Config
+
+	// Auth, if non-nil, enables the SMTP AUTH extension (RFC 4954)
+	// using the given backend.
+	Auth Authenticator
+
+	// AuthRequireTLS, if true, only advertises and accepts AUTH once
+	// STARTTLS has completed, so credentials are never sent in the
+	// clear.
+	AuthRequireTLS bool
 
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
-	OnNewConnection func(c Connection) os.Error
+	OnNewConnection func(c Connection) error
 
 	// OnNewMail must be defined and is called when a new message beings.
 	// (when a MAIL FROM line arrives)
-	OnNewMail func(c Connection, from MailAddress) (Envelope, os.Error)
+	OnNewMail func(c Connection, from MailAddress, opts MailOptions) (Envelope, error)
+
+	// ShutdownDrainTimeout bounds how long Shutdown waits for
+	// in-flight sessions (in particular, ones in the middle of DATA)
+	// to finish on their own before they're sent a 421 and closed.
+	// Zero means wait indefinitely.
+	ShutdownDrainTimeout int64
+
+	// ProxyProtocol enables support for the PROXY protocol used by L4
+	// load balancers (HAProxy, an AWS NLB, etc.) to convey the real
+	// client address. It defaults to ProxyProtocolOff; when set to
+	// any other value, every connection must begin with a PROXY
+	// header or it is rejected.
+	ProxyProtocol ProxyProtocol
+
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[*session]bool
+	closing  bool
+}
+
+// ProxyProtocol selects whether, and how, incoming connections are
+// expected to carry a PROXY protocol header ahead of the SMTP
+// protocol itself.
+type ProxyProtocol int
+
+const (
+	ProxyProtocolOff ProxyProtocol = iota // no PROXY header expected (default)
+	ProxyProtocolV1                       // PROXY protocol v1 (ASCII) only
+	ProxyProtocolV2                       // PROXY protocol v2 (binary) only
+	ProxyProtocolAny                      // either version, detected from the first bytes
+)
+
+// MailOptions holds the ESMTP parameters given on a MAIL FROM command
+// (RFC 1870 SIZE, RFC 6152 8BITMIME/BODY, RFC 6531 SMTPUTF8, RFC 3461
+// AUTH/RET/ENVID).
+type MailOptions struct {
+	Size  int64  // SIZE=, or 0 if not given
+	Body  string // BODY=, one of "7BIT", "8BITMIME", "BINARYMIME"
+	UTF8  bool   // SMTPUTF8 given
+	Auth  string // AUTH=<mailbox>, or "" if not given
+	Ret   string // RET=, one of "", "FULL", "HDRS"
+	Envid string // ENVID=, xtext-encoded envelope identifier
 }
 
-// MailAddress is defined by 
+// RcptOptions holds the ESMTP DSN parameters given on a RCPT TO
+// command (RFC 3461).
+type RcptOptions struct {
+	Notify []string // NOTIFY=, any of "NEVER", "SUCCESS", "FAILURE", "DELAY"
+	Orcpt  string   // ORCPT=, e.g. "rfc822;jdoe@example.com"
+}
+
+// MailAddress is defined by
 type MailAddress interface {
 	Email() string    // email address, as provided
 	Hostname() string // canonical hostname, lowercase
 }
 
+// Authenticator is implemented by SMTP AUTH backends and installed as
+// Server.Auth.
+type Authenticator interface {
+	// Mechanisms returns the SASL mechanism names this backend
+	// supports, e.g. []string{"PLAIN", "LOGIN", "CRAM-MD5"}. They are
+	// advertised verbatim in the EHLO response.
+	Mechanisms() []string
+
+	// Authenticate validates an AUTH attempt for the named mechanism.
+	// ir is the optional initial response sent with the AUTH command,
+	// or nil if none was given. For mechanisms that need more than one
+	// round trip (LOGIN, CRAM-MD5), Authenticate calls challenge with
+	// each server challenge and uses the returned client response to
+	// continue the exchange. It returns the authenticated identity on
+	// success.
+	Authenticate(mech string, ir []byte, challenge func([]byte) ([]byte, error)) (identity string, err error)
+}
+
 // Connection is implemented by the SMTP library and provided to callers
 // customizing their own Servers.
 type Connection interface {
+	// Addr returns the client's address: the one reported in a PROXY
+	// protocol header when Server.ProxyProtocol is enabled, otherwise
+	// the TCP peer itself.
 	Addr() net.Addr
+
+	// TCPAddr returns the actual TCP peer of the connection -- the
+	// load balancer's own address when ProxyProtocol is enabled, same
+	// as Addr() otherwise. OnNewConnection hooks can use it to
+	// enforce an allowlist of trusted proxies regardless of what the
+	// PROXY header itself claims.
+	TCPAddr() net.Addr
+
+	// TLSState returns the connection's TLS state once STARTTLS (or
+	// implicit TLS via ListenAndServeTLS) has completed, or nil if the
+	// session is still in the clear.
+	TLSState() *tls.ConnectionState
+
+	// AuthIdentity returns the identity authenticated via AUTH, or ""
+	// if the session has not authenticated.
+	AuthIdentity() string
 }
 
 type Envelope interface {
-	AddRecipient(rcpt MailAddress) os.Error
-	BeginData() os.Error
-	Write(line []byte) os.Error
+	AddRecipient(rcpt MailAddress, opts RcptOptions) error
+	BeginData() error
+	Write(line []byte) error
+}
+
+// EnvelopeCloser is an optional interface an Envelope may implement
+// to be notified once DATA has finished. ok is true if the message
+// was received intact and false if it was aborted partway through
+// (e.g. a size violation), in which case the Envelope should discard
+// anything buffered rather than act on it.
+type EnvelopeCloser interface {
+	Close(ok bool) error
 }
 
 type BasicEnvelope struct {
 	rcpts []MailAddress
 }
 
-func (e *BasicEnvelope) AddRecipient(rcpt MailAddress) os.Error {
+func (e *BasicEnvelope) AddRecipient(rcpt MailAddress, opts RcptOptions) error {
 	e.rcpts = append(e.rcpts, rcpt)
 	return nil
 }
 
-func (e *BasicEnvelope) BeginData() os.Error {
+func (e *BasicEnvelope) BeginData() error {
 	if len(e.rcpts) == 0 {
 		return SMTPError("554 5.5.1 Error: no valid recipients")
 	}
 	return nil
 }
 
-func (e *BasicEnvelope) Write(line []byte) os.Error {
+func (e *BasicEnvelope) Write(line []byte) error {
 	log.Printf("Line: %q", string(line))
 	return nil
 }
 
+const defaultMaxMessageBytes = 10 * 1024 * 1024 // 10MB
+
+func (srv *Server) maxMessageBytes() int64 {
+	if srv.MaxMessageBytes != 0 {
+		return srv.MaxMessageBytes
+	}
+	return defaultMaxMessageBytes
+}
+
 func (srv *Server) hostname() string {
 	if srv.Hostname != "" {
 		return srv.Hostname
@@ -94,7 +221,7 @@ func (srv *Server) hostname() string {
 // ListenAndServe listens on the TCP network address srv.Addr and then
 // calls Serve to handle requests on incoming connections.  If
 // srv.Addr is blank, ":25" is used.
-func (srv *Server) ListenAndServe() os.Error {
+func (srv *Server) ListenAndServe() error {
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":25"
@@ -106,11 +233,44 @@ func (srv *Server) ListenAndServe() os.Error {
 	return srv.Serve(ln)
 }
 
-func (srv *Server) Serve(ln net.Listener) os.Error {
+// ListenAndServeTLS listens on the TCP network address srv.Addr and
+// then calls Serve to handle requests on incoming TLS connections,
+// using srv.TLSConfig for the handshake.  Unlike STARTTLS, the TLS
+// handshake happens before the "220" greeting is sent; this is the
+// "implicit TLS" used on the submissions port (465).
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = new(tls.Config)
+	}
+	if len(srv.TLSConfig.Certificates) == 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":465"
+	}
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	return srv.Serve(tls.NewListener(ln, srv.TLSConfig))
+}
+
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	srv.listener = ln
+	srv.mu.Unlock()
 	defer ln.Close()
 	for {
 		rw, e := ln.Accept()
 		if e != nil {
+			if srv.isClosing() {
+				return nil
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				log.Printf("smtpd: Accept error: %v", e)
 				continue
@@ -118,18 +278,97 @@ func (srv *Server) Serve(ln net.Listener) os.Error {
 			return e
 		}
 		if srv.ReadTimeout != 0 {
-			rw.SetReadTimeout(srv.ReadTimeout)
+			rw.SetReadDeadline(time.Now().Add(time.Duration(srv.ReadTimeout)))
 		}
 		if srv.WriteTimeout != 0 {
-			rw.SetWriteTimeout(srv.WriteTimeout)
+			rw.SetWriteDeadline(time.Now().Add(time.Duration(srv.WriteTimeout)))
 		}
 		sess, err := srv.newSession(rw)
 		if err != nil {
 			continue
 		}
+		srv.trackSession(sess, true)
 		go sess.serve()
 	}
-	panic("not reached")
+}
+
+func (srv *Server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]bool)
+	}
+	if add {
+		srv.sessions[s] = true
+	} else {
+		delete(srv.sessions, s)
+	}
+}
+
+// Shutdown gracefully shuts down the server, modeled on
+// net/http.Server.Shutdown: it stops accepting new connections, then
+// waits for in-flight sessions to reach their next command boundary
+// and finish on their own, up to ShutdownDrainTimeout (or
+// indefinitely, if zero) or until ctx is done, whichever comes first,
+// before falling back to Close to send any stragglers a 421 and hang
+// up (RFC 5321 s3.8).
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	ln := srv.listener
+	srv.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+
+	drained := make(chan bool, 1)
+	go func() {
+		for srv.sessionCount() > 0 {
+			time.Sleep(100 * 1e6) // 100ms
+		}
+		drained <- true
+	}()
+
+	var drainTimeout <-chan time.Time
+	if srv.ShutdownDrainTimeout > 0 {
+		drainTimeout = time.After(time.Duration(srv.ShutdownDrainTimeout))
+	}
+	select {
+	case <-drained:
+	case <-drainTimeout:
+	case <-ctx.Done():
+	}
+	return srv.Close()
+}
+
+func (srv *Server) sessionCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.sessions)
+}
+
+// Close immediately stops the listener and forcibly terminates any
+// sessions still active, sending each a 421 before hanging up.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closing = true
+	ln := srv.listener
+	sessions := srv.sessions
+	srv.sessions = nil
+	srv.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	for s := range sessions {
+		s.sendShutdown()
+	}
+	return nil
 }
 
 type session struct {
@@ -138,13 +377,25 @@ type session struct {
 	br  *bufio.Reader
 	bw  *bufio.Writer
 
+	wmu sync.Mutex // guards writes to bw, so a shutdown notice can't
+	// interleave with a response in flight
+
+	shutdownOnce sync.Once // ensures sendShutdown runs at most once,
+	// even if Close/Shutdown and the session's own serve loop both
+	// decide to send it
+
 	env Envelope // current envelope, or nil
 
 	helloType string
 	helloHost string
+
+	tlsState     *tls.ConnectionState // set once STARTTLS has completed
+	authIdentity string               // set once AUTH has succeeded
+
+	proxyAddr net.Addr // real client address from a PROXY header, or nil
 }
 
-func (srv *Server) newSession(rwc net.Conn) (s *session, err os.Error) {
+func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
 	s = &session{
 		srv: srv,
 		rwc: rwc,
@@ -159,28 +410,82 @@ func (s *session) errorf(format string, args ...interface{}) {
 }
 
 func (s *session) sendf(format string, args ...interface{}) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
 	fmt.Fprintf(s.bw, format, args...)
 	s.bw.Flush()
 }
 
+// sendShutdown writes an RFC 5321 s3.8 shutdown notice through the
+// write lock, so it can't be interleaved with a response the session
+// loop is in the middle of sending, then closes the connection. It's
+// called from Server.Shutdown/Close, which run in a different
+// goroutine than the session's own serve loop, and from that loop
+// itself once it notices srv.isClosing(); shutdownOnce makes sure
+// whichever of the two gets there first is the only one that actually
+// writes the 421 and closes the connection.
+func (s *session) sendShutdown() {
+	s.shutdownOnce.Do(s.doSendShutdown)
+}
+
+func (s *session) doSendShutdown() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	fmt.Fprintf(s.bw, "421 4.7.0 %s Service shutting down, closing transmission channel\r\n", s.srv.hostname())
+	s.bw.Flush()
+	s.rwc.Close()
+}
+
 func (s *session) sendlinef(format string, args ...interface{}) {
 	s.sendf(format+"\r\n", args...)
 }
 
-func (s *session) sendSMTPErrorOrLinef(err os.Error, format string, args ...interface{}) {
+func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interface{}) {
 	if se, ok := err.(SMTPError); ok {
-		s.sendlinef("%s", se.String())
+		s.sendlinef("%s", se.Error())
 		return
 	}
 	s.sendlinef(format, args...)
 }
 
 func (s *session) Addr() net.Addr {
+	if s.proxyAddr != nil {
+		return s.proxyAddr
+	}
 	return s.rwc.RemoteAddr()
 }
 
+func (s *session) TCPAddr() net.Addr {
+	return s.rwc.RemoteAddr()
+}
+
+func (s *session) TLSState() *tls.ConnectionState {
+	return s.tlsState
+}
+
+func (s *session) AuthIdentity() string {
+	return s.authIdentity
+}
+
 func (s *session) serve() {
 	defer s.rwc.Close()
+	defer s.srv.trackSession(s, false)
+	if s.srv.ProxyProtocol != ProxyProtocolOff {
+		if err := s.readProxyHeader(); err != nil {
+			s.errorf("PROXY protocol error: %v", err)
+			return
+		}
+	}
+	if tc, ok := s.rwc.(*tls.Conn); ok {
+		// Implicit TLS (ListenAndServeTLS): finish the handshake
+		// before the greeting so TLSState is set from the start.
+		if err := tc.Handshake(); err != nil {
+			s.errorf("TLS handshake error: %v", err)
+			return
+		}
+		state := tc.ConnectionState()
+		s.tlsState = &state
+	}
 	if onc := s.srv.OnNewConnection; onc != nil {
 		if err := onc(s); err != nil {
 			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
@@ -189,6 +494,10 @@ func (s *session) serve() {
 	}
 	s.sendf("220 %s ESMTP gosmtpd\r\n", s.srv.hostname())
 	for {
+		if s.srv.isClosing() {
+			s.sendShutdown()
+			return
+		}
 		sl, err := s.br.ReadSlice('\n')
 		if err != nil {
 			s.errorf("read error: %v", err)
@@ -212,18 +521,15 @@ func (s *session) serve() {
 		case "NOOP":
 			s.sendlinef("250 2.0.0 OK")
 		case "MAIL":
-			arg := line.Arg() // "From:<foo@bar.com>"
-			m := mailFromRE.FindStringSubmatch(arg)
-			if m == nil {
-				log.Printf("invalid MAIL arg: %q", arg)
-				s.sendlinef("501 5.1.7 Bad sender address syntax")
-				continue
-			}
-			s.handleMailFrom(m[1])
+			s.handleMailFrom(line.Arg()) // "From:<foo@bar.com> SIZE=1024 ..."
 		case "RCPT":
 			s.handleRcpt(line)
 		case "DATA":
 			s.handleData()
+		case "STARTTLS":
+			s.handleStartTLS()
+		case "AUTH":
+			s.handleAuth(line)
 		default:
 			log.Printf("Client: %q, verhb: %q", line, line.Verb())
 			s.sendlinef("502 5.5.2 Error: command not recognized")
@@ -231,33 +537,320 @@ func (s *session) serve() {
 	}
 }
 
+// proxyV2Sig is the 12-byte signature that opens every PROXY protocol
+// v2 header.
+var proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// readProxyHeader consumes a PROXY protocol header (v1, v2, or
+// whichever of the two Server.ProxyProtocol calls for) from the front
+// of the connection, before any SMTP I/O, and sets s.proxyAddr to the
+// client address it reports.
+func (s *session) readProxyHeader() error {
+	switch s.srv.ProxyProtocol {
+	case ProxyProtocolV1:
+		return s.readProxyV1()
+	case ProxyProtocolV2:
+		return s.readProxyV2()
+	case ProxyProtocolAny:
+		peek, err := s.br.Peek(len(proxyV2Sig))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(peek, proxyV2Sig) {
+			return s.readProxyV2()
+		}
+		return s.readProxyV1()
+	}
+	return nil
+}
+
+// readProxyV1 parses the single ASCII line "PROXY TCP4 src dst sport
+// dport\r\n" (or TCP6, or "PROXY UNKNOWN ...\r\n" for connections the
+// balancer can't attribute).
+func (s *session) readProxyV1() error {
+	sl, err := s.br.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(strings.TrimRight(string(sl), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.New("malformed PROXY v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 {
+		return errors.New("malformed PROXY v1 header")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(fields[2], fields[4]))
+	if err != nil {
+		return err
+	}
+	s.proxyAddr = addr
+	return nil
+}
+
+// readProxyV2 parses the binary v2 header: the 12-byte signature, a
+// version/command byte, an address-family/protocol byte, a 2-byte
+// address length, and the address block itself (12 bytes for IPv4,
+// 36 for IPv6).
+func (s *session) readProxyV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(s.br, hdr); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return errors.New("bad PROXY v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return errors.New("unsupported PROXY v2 version")
+	}
+	cmd := hdr[12] & 0x0F
+	fam := hdr[13] >> 4
+	length := int(hdr[14])<<8 | int(hdr[15])
+
+	addr := make([]byte, length)
+	if _, err := io.ReadFull(s.br, addr); err != nil {
+		return err
+	}
+	if cmd == 0 {
+		// LOCAL: a health check from the balancer itself; no address
+		// to report.
+		return nil
+	}
+	switch fam {
+	case 0x1: // AF_INET
+		if len(addr) < 12 {
+			return errors.New("short PROXY v2 IPv4 address block")
+		}
+		s.proxyAddr = &net.TCPAddr{
+			IP:   net.IPv4(addr[0], addr[1], addr[2], addr[3]),
+			Port: int(addr[8])<<8 | int(addr[9]),
+		}
+	case 0x2: // AF_INET6
+		if len(addr) < 36 {
+			return errors.New("short PROXY v2 IPv6 address block")
+		}
+		ip := make(net.IP, 16)
+		copy(ip, addr[0:16])
+		s.proxyAddr = &net.TCPAddr{
+			IP:   ip,
+			Port: int(addr[32])<<8 | int(addr[33]),
+		}
+	}
+	return nil
+}
+
 func (s *session) handleHello(greeting, host string) {
 	s.helloType = greeting
 	s.helloHost = host
 	fmt.Fprintf(s.bw, "250-%s\r\n", s.srv.hostname())
-	for _, ext := range []string{
+	extensions := []string{
 		"250-PIPELINING",
-		"250-SIZE 10240000",
+		fmt.Sprintf("250-SIZE %d", s.srv.maxMessageBytes()),
 		"250-ENHANCEDSTATUSCODES",
 		"250-8BITMIME",
-		"250 DSN",
-	} {
+		"250-SMTPUTF8",
+	}
+	if s.srv.TLSConfig != nil && s.tlsState == nil {
+		extensions = append(extensions, "250-STARTTLS")
+	}
+	if auth := s.srv.Auth; auth != nil && (!s.srv.AuthRequireTLS || s.tlsState != nil) {
+		if mechs := auth.Mechanisms(); len(mechs) > 0 {
+			extensions = append(extensions, "250-AUTH "+strings.Join(mechs, " "))
+		}
+	}
+	extensions = append(extensions, "250 DSN")
+	for _, ext := range extensions {
 		fmt.Fprintf(s.bw, "%s\r\n", ext)
 	}
 	s.bw.Flush()
 }
 
-func (s *session) handleMailFrom(email string) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
+// handleStartTLS implements the STARTTLS verb (RFC 3207).  On success
+// the connection is wrapped in a TLS session and all prior state
+// (the current envelope and the hostname given in HELO/EHLO) is
+// discarded; the client is required to send EHLO again.
+func (s *session) handleStartTLS() {
+	if s.srv.TLSConfig == nil {
+		s.sendlinef("502 5.5.2 Error: STARTTLS not supported")
+		return
+	}
+	if s.tlsState != nil {
+		s.sendlinef("503 5.5.1 Error: TLS already active")
+		return
+	}
+	s.sendlinef("220 2.0.0 Ready to start TLS")
+
+	tc := tls.Server(s.rwc, s.srv.TLSConfig)
+	if err := tc.Handshake(); err != nil {
+		s.errorf("TLS handshake error: %v", err)
+		s.rwc.Close()
+		return
+	}
 
+	// RFC 3207 s4.2: discard any knowledge obtained from the client
+	// prior to the handshake, and require a new EHLO.
+	//
+	// s.wmu also guards s.rwc/s.br/s.bw themselves here, since
+	// Server.Shutdown/Close can call sendShutdown concurrently from
+	// another goroutine and must not read or write them mid-swap.
+	s.wmu.Lock()
+	s.rwc = tc
+	s.br = bufio.NewReader(tc)
+	s.bw = bufio.NewWriter(tc)
+	s.wmu.Unlock()
+	state := tc.ConnectionState()
+	s.tlsState = &state
+	s.helloType = ""
+	s.helloHost = ""
+	s.env = nil
+	s.authIdentity = ""
+}
+
+// handleAuth implements the AUTH verb (RFC 4954).
+func (s *session) handleAuth(line cmdLine) {
+	auth := s.srv.Auth
+	if auth == nil {
+		s.sendlinef("502 5.5.1 Error: AUTH not supported")
+		return
+	}
+	if s.srv.AuthRequireTLS && s.tlsState == nil {
+		s.sendlinef("538 5.7.11 Encryption required for requested auth mechanism")
+		return
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: AUTH not allowed during mail transaction")
+		return
+	}
+
+	args := strings.SplitN(line.Arg(), " ", 2)
+	mech := strings.ToUpper(args[0])
+	ok := false
+	for _, m := range auth.Mechanisms() {
+		if strings.ToUpper(m) == mech {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		s.sendlinef("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	var ir []byte
+	if len(args) == 2 {
+		if args[1] == "=" {
+			ir = []byte{}
+		} else {
+			decoded, err := base64.StdEncoding.DecodeString(args[1])
+			if err != nil {
+				s.sendlinef("501 5.5.2 Cannot decode response")
+				return
+			}
+			ir = decoded
+		}
+	}
+
+	identity, err := auth.Authenticate(mech, ir, s.authChallenge)
+	if err != nil {
+		s.sendSMTPErrorOrLinef(err, "535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.authIdentity = identity
+	s.sendlinef("235 2.7.0 Authentication successful")
+}
+
+// authChallenge sends challenge as a base64-encoded SMTP "334"
+// continuation line and returns the client's base64-decoded response.
+// It is passed to Authenticator.Authenticate so multi-step mechanisms
+// like LOGIN and CRAM-MD5 can drive their own exchange.
+func (s *session) authChallenge(challenge []byte) ([]byte, error) {
+	s.sendlinef("334 %s", base64.StdEncoding.EncodeToString(challenge))
+	sl, err := s.br.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := strings.TrimRight(string(sl), "\r\n")
+	if resp == "*" {
+		return nil, SMTPError("501 5.7.0 Authentication cancelled")
+	}
+	decoded, derr := base64.StdEncoding.DecodeString(resp)
+	if derr != nil {
+		return nil, SMTPError("501 5.5.2 Cannot decode response")
+	}
+	return decoded, nil
+}
+
+func (s *session) handleMailFrom(arg string) {
 	if s.env != nil {
 		s.sendlinef("503 5.5.1 Error: nested MAIL command")
 		return
 	}
-	log.Printf("mail from: %q", email)
+	m := mailFromRE.FindStringSubmatch(arg)
+	if m == nil {
+		log.Printf("invalid MAIL arg: %q", arg)
+		s.sendlinef("501 5.1.7 Bad sender address syntax")
+		return
+	}
+	email := m[1]
+
+	opts := MailOptions{Body: "7BIT"}
+	for key, val := range parseParams(m[2]) {
+		switch key {
+		case "SIZE":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 0 {
+				s.sendlinef("501 5.5.4 Syntax error in SIZE parameter")
+				return
+			}
+			if n > s.srv.maxMessageBytes() {
+				s.sendlinef("552 5.3.4 Message size exceeds fixed maximum")
+				return
+			}
+			opts.Size = n
+		case "BODY":
+			switch strings.ToUpper(val) {
+			case "7BIT", "8BITMIME", "BINARYMIME":
+				opts.Body = strings.ToUpper(val)
+			default:
+				s.sendlinef("501 5.5.4 Syntax error in BODY parameter")
+				return
+			}
+		case "SMTPUTF8":
+			opts.UTF8 = true
+		case "AUTH":
+			opts.Auth = val
+		case "RET":
+			switch strings.ToUpper(val) {
+			case "FULL", "HDRS":
+				opts.Ret = strings.ToUpper(val)
+			default:
+				s.sendlinef("501 5.5.4 Syntax error in RET parameter")
+				return
+			}
+		case "ENVID":
+			opts.Envid = val
+		default:
+			// 4.1.1.11: if the server SMTP does not recognize or
+			// cannot implement one or more of the parameters
+			// associated with a particular MAIL FROM command, it
+			// returns code 555.
+			s.sendlinef("555 5.5.4 Unsupported option: %s", key)
+			return
+		}
+	}
+	if opts.UTF8 {
+		if !utf8.ValidString(email) {
+			s.sendlinef("501 5.6.7 Invalid UTF-8 in mailbox")
+			return
+		}
+	} else if !isASCII(email) {
+		s.sendlinef("550 5.6.7 Non-ASCII address requires SMTPUTF8")
+		return
+	}
+
+	log.Printf("mail from: %q %+v", email, opts)
 	cb := s.srv.OnNewMail
 	if cb == nil {
 		log.Printf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
@@ -265,7 +858,7 @@ func (s *session) handleMailFrom(email string) {
 		return
 	}
 	s.env = nil
-	env, err := cb(s, addrString(email))
+	env, err := cb(s, addrString(email), opts)
 	if err != nil {
 		log.Printf("rejecting MAIL FROM %q: %v", email, err)
 		// TODO: send it back to client if warranted, like above
@@ -276,11 +869,6 @@ func (s *session) handleMailFrom(email string) {
 }
 
 func (s *session) handleRcpt(line cmdLine) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
-
 	if s.env == nil {
 		s.sendlinef("503 5.5.1 Error: need MAIL command")
 		return
@@ -292,7 +880,23 @@ func (s *session) handleRcpt(line cmdLine) {
 		s.sendlinef("501 5.1.7 Bad sender address syntax")
 		return
 	}
-	err := s.env.AddRecipient(addrString(m[1]))
+	email := m[1]
+
+	var opts RcptOptions
+	for key, val := range parseParams(m[2]) {
+		switch key {
+		case "NOTIFY":
+			opts.Notify = strings.Split(val, ",")
+		case "ORCPT":
+			opts.Orcpt = val
+		default:
+			// 4.1.1.11: see handleMailFrom.
+			s.sendlinef("555 5.5.4 Unsupported option: %s", key)
+			return
+		}
+	}
+
+	err := s.env.AddRecipient(addrString(email), opts)
 	if err != nil {
 		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
 		return
@@ -300,6 +904,32 @@ func (s *session) handleRcpt(line cmdLine) {
 	s.sendlinef("250 2.1.0 Ok")
 }
 
+// parseParams splits the ESMTP parameters following a MAIL FROM or
+// RCPT TO address (e.g. "SIZE=12345 BODY=8BITMIME") into a key/value
+// map. Keys are upper-cased; parameters given without a value (such
+// as SMTPUTF8) map to "".
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, tok := range strings.Fields(s) {
+		if idx := strings.Index(tok, "="); idx != -1 {
+			params[strings.ToUpper(tok[:idx])] = tok[idx+1:]
+		} else {
+			params[strings.ToUpper(tok)] = ""
+		}
+	}
+	return params
+}
+
+// isASCII reports whether s contains only 7-bit ASCII bytes.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *session) handleData() {
 	if s.env == nil {
 		s.sendlinef("503 5.5.1 Error: need RCPT command")
@@ -310,6 +940,9 @@ func (s *session) handleData() {
 		return
 	}
 	s.sendlinef("354 Go ahead")
+	max := s.srv.maxMessageBytes()
+	var size int64
+	overflow := false
 	for {
 		sl, err := s.br.ReadSlice('\n')
 		if err != nil {
@@ -322,16 +955,39 @@ func (s *session) handleData() {
 		if sl[0] == '.' {
 			sl = sl[1:]
 		}
+		if overflow {
+			// Keep draining to the end-of-data dot so any
+			// pipelined commands that follow aren't misread as
+			// part of the message.
+			continue
+		}
+		size += int64(len(sl))
+		if size > max {
+			overflow = true
+			continue
+		}
 		err = s.env.Write(sl)
 		if err != nil {
 			s.sendSMTPErrorOrLinef(err, "550 ??? failed")
 			return
 		}
 	}
+	if closer, ok := s.env.(EnvelopeCloser); ok {
+		if err := closer.Close(!overflow); err != nil {
+			s.sendSMTPErrorOrLinef(err, "450 4.3.0 Error: could not process message")
+			s.env = nil
+			return
+		}
+	}
+	if overflow {
+		s.sendlinef("552 5.3.4 Message size exceeds fixed maximum")
+		s.env = nil
+		return
+	}
 	s.sendlinef("250 2.0.0 Ok: queued")
 }
 
-func (s *session) handleError(err os.Error) {
+func (s *session) handleError(err error) {
 	if se, ok := err.(SMTPError); ok {
 		s.sendlinef("%s", se)
 		return
@@ -355,16 +1011,16 @@ func (a addrString) Hostname() string {
 
 type cmdLine string
 
-func (cl cmdLine) checkValid() os.Error {
+func (cl cmdLine) checkValid() error {
 	if !strings.HasSuffix(string(cl), "\r\n") {
-		return os.NewError(`line doesn't end in \r\n`)
+		return errors.New(`line doesn't end in \r\n`)
 	}
 	// Check for verbs defined not to have an argument
 	// (RFC 5321 s4.1.1)
 	switch cl.Verb() {
-	case "RSET", "DATA", "QUIT":
+	case "RSET", "DATA", "QUIT", "STARTTLS":
 		if cl.Arg() != "" {
-			return os.NewError("unexpected argument")
+			return errors.New("unexpected argument")
 		}
 	}
 	return nil
@@ -392,6 +1048,6 @@ func (cl cmdLine) String() string {
 
 type SMTPError string
 
-func (e SMTPError) String() string {
+func (e SMTPError) Error() string {
 	return string(e)
 }
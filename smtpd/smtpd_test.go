@@ -0,0 +1,250 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestSession(input string) (*session, *bytes.Buffer) {
+	var out bytes.Buffer
+	s := &session{
+		srv: &Server{},
+		br:  bufio.NewReader(strings.NewReader(input)),
+		bw:  bufio.NewWriter(&out),
+	}
+	return s, &out
+}
+
+// --- PROXY protocol ---
+
+func TestReadProxyV1(t *testing.T) {
+	s, _ := newTestSession("")
+	s.br = bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 192.0.2.2 12345 25\r\n"))
+	if err := s.readProxyV1(); err != nil {
+		t.Fatalf("readProxyV1: %v", err)
+	}
+	addr, ok := s.proxyAddr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("proxyAddr type = %T, want *net.TCPAddr", s.proxyAddr)
+	}
+	if addr.IP.String() != "192.0.2.1" || addr.Port != 12345 {
+		t.Errorf("proxyAddr = %v, want 192.0.2.1:12345", addr)
+	}
+}
+
+func TestReadProxyV1Unknown(t *testing.T) {
+	s, _ := newTestSession("")
+	s.br = bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	if err := s.readProxyV1(); err != nil {
+		t.Fatalf("readProxyV1: %v", err)
+	}
+	if s.proxyAddr != nil {
+		t.Errorf("proxyAddr = %v, want nil for PROXY UNKNOWN", s.proxyAddr)
+	}
+}
+
+func TestReadProxyV1Malformed(t *testing.T) {
+	s, _ := newTestSession("")
+	s.br = bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1\r\n"))
+	if err := s.readProxyV1(); err == nil {
+		t.Fatalf("readProxyV1: want error on malformed header, got nil")
+	}
+}
+
+func TestReadProxyV2IPv4(t *testing.T) {
+	var hdr bytes.Buffer
+	hdr.Write(proxyV2Sig)
+	hdr.WriteByte(0x21) // version 2, command PROXY
+	hdr.WriteByte(0x11) // AF_INET, STREAM
+	addr := []byte{
+		192, 0, 2, 1, // src IP
+		192, 0, 2, 2, // dst IP
+		0x30, 0x39, // src port 12345
+		0x00, 0x19, // dst port 25
+	}
+	hdr.WriteByte(byte(len(addr) >> 8))
+	hdr.WriteByte(byte(len(addr)))
+	hdr.Write(addr)
+
+	s, _ := newTestSession("")
+	s.br = bufio.NewReader(&hdr)
+	if err := s.readProxyV2(); err != nil {
+		t.Fatalf("readProxyV2: %v", err)
+	}
+	got, ok := s.proxyAddr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("proxyAddr type = %T, want *net.TCPAddr", s.proxyAddr)
+	}
+	if got.IP.String() != "192.0.2.1" || got.Port != 12345 {
+		t.Errorf("proxyAddr = %v, want 192.0.2.1:12345", got)
+	}
+}
+
+func TestReadProxyV2Local(t *testing.T) {
+	var hdr bytes.Buffer
+	hdr.Write(proxyV2Sig)
+	hdr.WriteByte(0x20) // version 2, command LOCAL
+	hdr.WriteByte(0x00) // AF_UNSPEC
+	hdr.WriteByte(0)
+	hdr.WriteByte(0)
+
+	s, _ := newTestSession("")
+	s.br = bufio.NewReader(&hdr)
+	if err := s.readProxyV2(); err != nil {
+		t.Fatalf("readProxyV2: %v", err)
+	}
+	if s.proxyAddr != nil {
+		t.Errorf("proxyAddr = %v, want nil for LOCAL command", s.proxyAddr)
+	}
+}
+
+func TestReadProxyV2BadSignature(t *testing.T) {
+	s, _ := newTestSession("")
+	s.br = bufio.NewReader(bytes.NewBufferString("not a proxy header!!"))
+	if err := s.readProxyV2(); err == nil {
+		t.Fatalf("readProxyV2: want error on bad signature, got nil")
+	}
+}
+
+// --- AUTH ---
+
+type fakeAuth struct{}
+
+func (fakeAuth) Mechanisms() []string { return []string{"PLAIN", "LOGIN"} }
+
+func (fakeAuth) Authenticate(mech string, ir []byte, challenge func([]byte) ([]byte, error)) (string, error) {
+	switch mech {
+	case "PLAIN":
+		parts := bytes.Split(ir, []byte{0})
+		if len(parts) != 3 || string(parts[1]) != "user" || string(parts[2]) != "pass" {
+			return "", SMTPError("535 5.7.8 Authentication credentials invalid")
+		}
+		return "user", nil
+	case "LOGIN":
+		u, err := challenge([]byte("Username:"))
+		if err != nil {
+			return "", err
+		}
+		p, err := challenge([]byte("Password:"))
+		if err != nil {
+			return "", err
+		}
+		if string(u) != "user" || string(p) != "pass" {
+			return "", SMTPError("535 5.7.8 Authentication credentials invalid")
+		}
+		return "user", nil
+	}
+	return "", SMTPError("504 5.5.4 Unrecognized authentication type")
+}
+
+func TestHandleAuthPlain(t *testing.T) {
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00user\x00pass"))
+	s, out := newTestSession("")
+	s.srv.Auth = fakeAuth{}
+	s.handleAuth(cmdLine("AUTH PLAIN " + ir + "\r\n"))
+	if !strings.Contains(out.String(), "235 2.7.0") {
+		t.Fatalf("response = %q, want 235 success", out.String())
+	}
+	if s.authIdentity != "user" {
+		t.Errorf("authIdentity = %q, want \"user\"", s.authIdentity)
+	}
+}
+
+func TestHandleAuthPlainBadCreds(t *testing.T) {
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00user\x00wrong"))
+	s, out := newTestSession("")
+	s.srv.Auth = fakeAuth{}
+	s.handleAuth(cmdLine("AUTH PLAIN " + ir + "\r\n"))
+	if !strings.Contains(out.String(), "535 5.7.8") {
+		t.Fatalf("response = %q, want 535 failure", out.String())
+	}
+	if s.authIdentity != "" {
+		t.Errorf("authIdentity = %q, want empty after failed auth", s.authIdentity)
+	}
+}
+
+func TestHandleAuthLogin(t *testing.T) {
+	u := base64.StdEncoding.EncodeToString([]byte("user"))
+	p := base64.StdEncoding.EncodeToString([]byte("pass"))
+	s, out := newTestSession(u + "\r\n" + p + "\r\n")
+	s.srv.Auth = fakeAuth{}
+	s.handleAuth(cmdLine("AUTH LOGIN\r\n"))
+	if !strings.Contains(out.String(), "334 ") {
+		t.Fatalf("response = %q, want 334 challenges", out.String())
+	}
+	if !strings.Contains(out.String(), "235 2.7.0") {
+		t.Fatalf("response = %q, want 235 success", out.String())
+	}
+	if s.authIdentity != "user" {
+		t.Errorf("authIdentity = %q, want \"user\"", s.authIdentity)
+	}
+}
+
+func TestHandleAuthUnsupportedMechanism(t *testing.T) {
+	s, out := newTestSession("")
+	s.srv.Auth = fakeAuth{}
+	s.handleAuth(cmdLine("AUTH GSSAPI\r\n"))
+	if !strings.Contains(out.String(), "504 5.5.4") {
+		t.Fatalf("response = %q, want 504 unsupported mechanism", out.String())
+	}
+}
+
+// --- SIZE / DATA overflow ---
+
+type fakeEnvelope struct {
+	lines    [][]byte
+	closed   bool
+	closedOK bool
+}
+
+func (e *fakeEnvelope) AddRecipient(rcpt MailAddress, opts RcptOptions) error { return nil }
+func (e *fakeEnvelope) BeginData() error                                      { return nil }
+
+func (e *fakeEnvelope) Write(line []byte) error {
+	e.lines = append(e.lines, append([]byte{}, line...))
+	return nil
+}
+
+func (e *fakeEnvelope) Close(ok bool) error {
+	e.closed = true
+	e.closedOK = ok
+	return nil
+}
+
+func TestHandleDataWithinLimit(t *testing.T) {
+	s, out := newTestSession("hello\r\nworld\r\n.\r\n")
+	s.srv.MaxMessageBytes = 100
+	env := &fakeEnvelope{}
+	s.env = env
+	s.handleData()
+	if !strings.Contains(out.String(), "250 2.0.0 Ok: queued") {
+		t.Fatalf("response = %q, want 250 queued", out.String())
+	}
+	if !env.closed || !env.closedOK {
+		t.Errorf("Close(ok) = (%v, %v), want (true, true)", env.closed, env.closedOK)
+	}
+	if len(env.lines) != 2 {
+		t.Errorf("got %d lines, want 2", len(env.lines))
+	}
+}
+
+func TestHandleDataOverflow(t *testing.T) {
+	s, out := newTestSession("AAAAAAAAAA\r\nBBBBBBBBBB\r\n.\r\n")
+	s.srv.MaxMessageBytes = 5
+	env := &fakeEnvelope{}
+	s.env = env
+	s.handleData()
+	if !strings.Contains(out.String(), "552 5.3.4") {
+		t.Fatalf("response = %q, want 552 size exceeded", out.String())
+	}
+	if !env.closed || env.closedOK {
+		t.Errorf("Close(ok) = (%v, %v), want (true, false) on overflow", env.closed, env.closedOK)
+	}
+	if s.env != nil {
+		t.Errorf("s.env = %v, want nil after overflow", s.env)
+	}
+}